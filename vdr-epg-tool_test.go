@@ -0,0 +1,774 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "flag"
+    "fmt"
+    "io"
+    "maps"
+    "net"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// a stand-in for VDR's SVDRP server, answers the commands epg-load sends
+// and records them
+type FakeVDR struct {
+    ln net.Listener
+
+    mu       sync.Mutex
+    commands []string
+
+    // the lines of the PUTE blocks since the last CLRE, for LSTE
+    epg []string
+}
+
+// a FakeVDR on a free local port, closed at the end of the test
+func fake_vdr(t *testing.T) *FakeVDR {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    f := &FakeVDR{ln: ln}
+    go f.serve()
+    t.Cleanup(func() { f.ln.Close() })
+    return f
+}
+
+func (f *FakeVDR) addr() string {
+    return f.ln.Addr().String()
+}
+
+// accepts connections until the listener is closed
+func (f *FakeVDR) serve() {
+    for {
+        c, err := f.ln.Accept()
+        if err != nil {
+            return
+        }
+        go f.session(c)
+    }
+}
+
+// the commands (and PUTE data lines) received so far
+func (f *FakeVDR) recorded() []string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return slices.Clone(f.commands)
+}
+
+func (f *FakeVDR) record(cmd string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.commands = append(f.commands, cmd)
+}
+
+// the EPG lines left after a CLRE of channel, "" clears everything
+func fake_vdr_clear(epg []string, channel string) []string {
+    if channel == "" {
+        return nil
+    }
+    kept := []string{}
+    drop := false
+    for _, l := range epg {
+        if strings.HasPrefix(l, "C ") == true {
+            drop = strings.SplitN(l[2:], " ", 2)[0] == channel
+        }
+        if drop == false {
+            kept = append(kept, l)
+        }
+        if l == "c" {
+            drop = false
+        }
+    }
+    return kept
+}
+
+func (f *FakeVDR) session(c net.Conn) {
+    defer c.Close()
+
+    reply := func(code int, text string) {
+        fmt.Fprintf(c, "%d %s\r\n", code, text)
+    }
+
+    reply(VDR_SC_SERVICE_READY, "fakevdr SVDRP VideoDiskRecorder 2.6.0; "+time.Now().Format(time.RFC1123Z)+"; UTF-8")
+
+    r := bufio.NewReader(c)
+    pute := false
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            return
+        }
+        line = strings.TrimRight(line, "\r\n")
+        f.record(line)
+
+        // EPG data after PUTE, up to a single '.'
+        if pute == true {
+            if line == "." {
+                pute = false
+                reply(VDR_SC_ACTION_OK, "EPG data processed")
+            } else {
+                f.mu.Lock()
+                f.epg = append(f.epg, line)
+                f.mu.Unlock()
+            }
+            continue
+        }
+
+        cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+        switch cmd {
+        case "PUTE":
+            pute = true
+            reply(VDR_SC_EPG_START_SENDING, "Enter EPG data, end with \".\" on a line by itself")
+        case "CLRE":
+            f.mu.Lock()
+            f.epg = fake_vdr_clear(f.epg, strings.TrimSpace(strings.TrimPrefix(line, strings.SplitN(line, " ", 2)[0])))
+            f.mu.Unlock()
+            reply(VDR_SC_ACTION_OK, "EPG data cleared")
+        case "LSTE":
+            f.mu.Lock()
+            for _, l := range f.epg {
+                fmt.Fprintf(c, "%d-%s\r\n", VDR_SC_EPG_DATA_REC, l)
+            }
+            f.mu.Unlock()
+            reply(VDR_SC_EPG_DATA_REC, "End of EPG data")
+        case "STAT", "PING":
+            reply(VDR_SC_ACTION_OK, "fakevdr is alive")
+        case "QUIT":
+            reply(VDR_SC_SERVICE_CLOSING, "fakevdr closing connection")
+            return
+        default:
+            reply(VDR_SC_SYNTAX_ERR_CMD_UNREC, "Command unrecognized: \""+cmd+"\"")
+        }
+    }
+}
+
+func TestReadReply(t *testing.T) {
+    for _, tc := range []struct {
+        name   string
+        data   string
+        status string
+        text   string
+        err    bool
+    }{
+        {"single line", "250 EPG data cleared\r\n", "250", "EPG data cleared", false},
+        {"LF only", "221 closing\n", "221", "closing", false},
+        {"code only", "250\r\n", "250", "", false},
+        {"multi line", "215-E 1 2 3\r\n215-T Title\r\n215 End of EPG data\r\n", "215", "E 1 2 3\nT Title\nEnd of EPG data", false},
+        {"stops at the final line", "250-a\r\n250 b\r\n220 next\r\n", "250", "a\nb", false},
+        {"empty", "", "", "", true},
+        {"EOF in a multi line reply", "215-E 1 2 3\r\n215-T Title\r\n", "", "E 1 2 3\nT Title", true},
+        {"EOF without a line end", "250 ok", "", "", true},
+        {"short line", "25\r\n", "", "", true},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            status, text, err := svdrp_read_reply(bufio.NewReader(strings.NewReader(tc.data)))
+            if (err != nil) != tc.err {
+                t.Fatalf("error %v, want one: %v", err, tc.err)
+            }
+            if status != tc.status || text != tc.text {
+                t.Errorf("got %q %q, want %q %q", status, text, tc.status, tc.text)
+            }
+        })
+    }
+}
+
+// the R value of every rating system, VDR_RATING_NONE is no R line at all
+func TestRating(t *testing.T) {
+    for _, tc := range []struct {
+        system string
+        value  string
+        want   int
+    }{
+        {"FSK", "0", 0},
+        {"FSK", "6", 6},
+        {"FSK", "12", 12},
+        {"FSK", "16", 16},
+        {"FSK", "18", 18},
+        {"fsk", " 16 ", 16},
+        {"FSK", "21", 0},
+        {"VCHIP", "TV-Y", 2},
+        {"VCHIP", "TV-Y7", 7},
+        {"VCHIP", "TV-G", 8},
+        {"VCHIP", "TV-PG", 10},
+        {"VCHIP", "TV-14", 14},
+        {"VCHIP", "TV-MA", 18},
+        {"", "TV-14", 14},
+        {"MPAA", "G", 8},
+        {"MPAA", "PG", 10},
+        {"MPAA", "PG-13", 13},
+        {"MPAA", "R", 17},
+        {"MPAA", "NC-17", 18},
+        {"BBFC", "U", 4},
+        {"BBFC", "PG", 8},
+        {"BBFC", "12A", 12},
+        {"BBFC", "15", 15},
+        {"BBFC", "R18", 18},
+        {"MPAA", "", 0},
+        {"", "", 0},
+        {"KIJKWIJZER", "12", VDR_RATING_NONE},
+    } {
+        if got := xmltv_rating([]Rating{{System: tc.system, Value: tc.value}}, discard_logger()); got != tc.want {
+            t.Errorf("%q %q: got %d, want %d", tc.system, tc.value, got, tc.want)
+        }
+    }
+
+    if got := xmltv_rating(nil, discard_logger()); got != 0 {
+        t.Errorf("no rating: got %d, want 0", got)
+    }
+    // the first rating of a known system counts
+    rs := []Rating{{System: "KIJKWIJZER", Value: "12"}, {System: "FSK", Value: "16"}, {System: "MPAA", Value: "R"}}
+    if got := xmltv_rating(rs, discard_logger()); got != 16 {
+        t.Errorf("several ratings: got %d, want 16", got)
+    }
+}
+
+// --genre-locale is per load: German names on top of the English ones,
+// a load without it doesn't know them
+func TestGenreLocale(t *testing.T) {
+    de, err := genre_lookup_locale("de")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, tc := range []struct {
+        category string
+        lookup   map[string][]int
+        want     []int
+    }{
+        {"Krimi", de, []int{0x11}},
+        {"Komödie", de, []int{0x14}},
+        {"News", de, []int{0x20}},
+        {"Comedy", de, []int{0x14}},
+        {"Quatsch", de, []int{0}},
+        {"Krimi", nil, []int{0}},
+        {"News", nil, []int{0x20}},
+    } {
+        p := Programme{Channel: "WCVB", Start: "20240101180000 +0000", Stop: "20240101183000 +0000", Title: "Tatort", Categories: []Category{{Value: tc.category}}}
+        opts := XMLTVOptions{GenreMode: GENRE_MODE_ALL, Genres: tc.lookup, Log: discard_logger()}
+        if got := xmltv_to_event(p, "WCVB", opts).GGenres; slices.Equal(got, tc.want) == false {
+            t.Errorf("%s (German %v): got %v, want %v", tc.category, tc.lookup != nil, got, tc.want)
+        }
+    }
+
+    if g, err := parse_genre_specs("Spielfilm,News", de); err != nil || slices.Equal(g, []int{0x10, 0x20}) == false {
+        t.Errorf("German genre specs: got %v, %v", g, err)
+    }
+    if _, err := parse_genre_specs("Spielfilm", genres); err == nil {
+        t.Errorf("German genre spec without the German lookup: no error")
+    }
+}
+
+// the same moment with different offsets is the same event for VDR
+func TestEventTimesOffset(t *testing.T) {
+    opts := test_load_options()
+    opts.LineEnding = LINE_ENDING_LF
+
+    var want bytes.Buffer
+    vdr_format_event(&want, test_event("WCVB", "20240101180000 +0000", "20240101183000 +0000", "News"), opts)
+    for _, tc := range [][2]string{
+        {"20240101180000", "20240101183000"},
+        {"20240101200000 +0200", "20240101203000 +0200"},
+        {"20240101130000 -0500", "20240101133000 -0500"},
+        {"202401011800 +0000", "20240101193000 +0100"},
+    } {
+        var got bytes.Buffer
+        vdr_format_event(&got, test_event("WCVB", tc[0], tc[1], "News"), opts)
+        if got.String() != want.String() {
+            t.Errorf("%s - %s:\n%s\nwant:\n%s", tc[0], tc[1], got.String(), want.String())
+        }
+    }
+}
+
+// channel ids, names and providers of the 10 field (1.x) and 13 field
+// (2.x) layouts of channels.conf
+func TestLoadChannels(t *testing.T) {
+    type want struct {
+        id       string
+        name     string
+        provider string
+    }
+    for _, tc := range []struct {
+        file string
+        chs  map[string]want
+    }{
+        {"channels-1x.conf", map[string]want{
+            "DASERSTE": {"S19.2E-0-11837-28106", "Das Erste", ""},
+            "ZDF":      {"S19.2E-0-11954-28006", "ZDF", ""},
+            "WOLD":     {"S19.2E-0-12188-12003", "Old", ""},
+        }},
+        {"channels-2x.conf", map[string]want{
+            "WCVB":       {"A-0-509-3", "ABC", ""},
+            "WGBH":       {"A-0-515-4", "PBS", "Public Broadcasting"},
+            "DASERSTEHD": {"S19.2E-1-1019-10301", "Das Erste HD", "ARD"},
+            "WSTR":       {"I-1-2-3", "Stream", ""},
+        }},
+    } {
+        t.Run(tc.file, func(t *testing.T) {
+            chs, err := load_vdr_channels_path(filepath.Join("testdata", tc.file), CHANNELS_FORMAT_CONF, discard_logger())
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(chs) != len(tc.chs) {
+                t.Errorf("%d channels, want %d", len(chs), len(tc.chs))
+            }
+            for cs, w := range tc.chs {
+                ch, found := chs[cs]
+                if found == false {
+                    t.Errorf("%s: missing", cs)
+                    continue
+                }
+                if got := (want{ch.ChannelId, ch.Name, ch.Provider}); got != w {
+                    t.Errorf("%s: got %+v, want %+v", cs, got, w)
+                }
+            }
+        })
+    }
+}
+
+// sftp reads a batch line like a shell would, a quote in a path must
+// not end the argument
+func TestSFTPQuote(t *testing.T) {
+    for _, tc := range [][2]string{
+        {"/epg/guide.xml", `"/epg/guide.xml"`},
+        {"/epg/my guide.xml", `"/epg/my guide.xml"`},
+        {`/epg/"guide".xml`, `"/epg/\"guide\".xml"`},
+        {`/epg/back\slash.xml`, `"/epg/back\\slash.xml"`},
+    } {
+        if got := sftp_quote(tc[0]); got != tc[1] {
+            t.Errorf("%s: got %s, want %s", tc[0], got, tc[1])
+        }
+    }
+}
+
+// pluto.tv ids are opaque and their display-names numbered, they only
+// match with --iptv: by id as a callsign or by the name after the number
+func TestMatchIPTV(t *testing.T) {
+    chs, err := load_vdr_channels_path(filepath.Join("testdata", "pluto-channels.conf"), CHANNELS_FORMAT_CONF, discard_logger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    f, err := os.Open(filepath.Join("testdata", "pluto.xml"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    feed, _, err := ParseXMLTV(f, XMLTVOptions{Log: discard_logger()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    ids := make(map[string]Channel)
+    for _, ch := range feed {
+        ids[ch.Id] = ch
+    }
+
+    for _, tc := range []struct {
+        id   string
+        want string
+        how  string
+    }{
+        {"5dcb62e63d4d8f0009f36881", "PLUTOMOVIES", "display-name 101 Pluto TV Movies"},
+        {"5e84f54a1d7ad1000791e0c4", "PlutoTVCrime", "display-name 102 Pluto TV Crime"},
+        {"5ad9b8551b95267e225e59c1", "5ad9b8551b95267e225e59c1", "id 5ad9b8551b95267e225e59c1"},
+        {"5f4d8594eb979c0007706de7", "", ""},
+    } {
+        ch, found := ids[tc.id]
+        if found == false {
+            t.Errorf("%s: not in the feed", tc.id)
+            continue
+        }
+        if cs, how := xmltv_match_iptv(ch, chs); cs != tc.want || how != tc.how {
+            t.Errorf("%s: got %q (%s), want %q (%s)", tc.id, cs, how, tc.want, tc.how)
+        }
+        if cs := xmltv_match_channel(ch, chs, NamePriority{}, true, discard_logger()); cs != tc.want {
+            t.Errorf("%s with --iptv: got %q, want %q", tc.id, cs, tc.want)
+        }
+        if cs := xmltv_match_channel(ch, chs, NamePriority{}, false, discard_logger()); cs != "" {
+            t.Errorf("%s without --iptv: got %q, want no match", tc.id, cs)
+        }
+    }
+}
+
+// load options as epg-load has them by default
+func test_load_options() VDRLoadOptions {
+    return VDRLoadOptions{
+        ClearScope:     CLEAR_SCOPE_ALL,
+        Version:        -1,
+        MaxTitleLen:    VDR_MAX_TITLE_LEN,
+        MaxSubTitleLen: VDR_MAX_SUBTITLE_LEN,
+        MaxDescLen:     VDR_MAX_DESC_LEN,
+        LineEnding:     LINE_ENDING_AUTO,
+        Log:            discard_logger(),
+    }
+}
+
+func test_channels() map[string]VDRChannel {
+    chs := make(map[string]VDRChannel)
+    for _, line := range []string{
+        "ABC,WCVB:509028:M10:A:0:49=2:0:0:0:3:0:0:0",
+        "PBS,WGBH:515028:M10:A:0:49=2:0:0:0:4:0:0:0",
+    } {
+        ch, err := vdr_parse_channel(line)
+        if err != nil {
+            panic(err)
+        }
+        chs[ch.CallSign] = ch
+    }
+    return chs
+}
+
+// feeds events to a Loader talking to f
+func test_load(f *FakeVDR, opts VDRLoadOptions, events []VDREPGEvent) (LoadSummary, error) {
+    comm := make(chan VDREPGEvent)
+    go func() {
+        for _, e := range events {
+            comm <- e
+        }
+        close(comm)
+    }()
+    ld := Loader{Host: f.addr(), Options: opts}
+    return ld.Load(context.Background(), test_channels(), comm)
+}
+
+func test_event(cs string, start string, stop string, title string) VDREPGEvent {
+    return VDREPGEvent{ChannelCallSign: cs, EEStartTime: start, EEStopTime: stop, TTitle: title, RRating: VDR_RATING_NONE}
+}
+
+func TestLoadCommands(t *testing.T) {
+    f := fake_vdr(t)
+    events := []VDREPGEvent{
+        test_event("WCVB", "20240101180000 +0000", "20240101183000 +0000", "Evening News"),
+        test_event("WCVB", "20240101183000 +0000", "20240101190000 +0000", "Weather"),
+        test_event("WGBH", "20240101180000 +0000", "20240101190000 +0000", "Nova"),
+    }
+    if _, err := test_load(f, test_load_options(), events); err != nil {
+        t.Fatal(err)
+    }
+
+    want := []string{
+        "CLRE",
+        "PUTE",
+        "C A-0-509-3 WCVB",
+        "E 25545 1704132000 1800 0",
+        "T Evening News",
+        "D ",
+        "G ",
+        "e",
+        "E 25575 1704133800 1800 0",
+        "T Weather",
+        "D ",
+        "G ",
+        "e",
+        "c",
+        ".",
+        "PUTE",
+        "C A-0-515-4 WGBH",
+        "E 25545 1704132000 3600 0",
+        "T Nova",
+        "D ",
+        "G ",
+        "e",
+        "c",
+        ".",
+        "QUIT",
+    }
+    if got := f.recorded(); slices.Equal(got, want) == false {
+        t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+    }
+}
+
+// degenerate programmes are skipped, not sent and not a panic
+func TestLoadIncompleteProgrammes(t *testing.T) {
+    f := fake_vdr(t)
+    job := EPGLoadJob{
+        ChannelsConf: filepath.Join("testdata", "channels-2x.conf"),
+        XMLTVSource:  filepath.Join("testdata", "empty-programmes.xml"),
+        VDRHost:      f.addr(),
+        XMLTV:        XMLTVOptions{GenreMode: GENRE_MODE_ALL, DescSeparator: "|"},
+        Load:         test_load_options(),
+    }
+    if _, err := epg_load(job); err != nil {
+        t.Fatal(err)
+    }
+
+    titles := []string{}
+    for _, cmd := range f.recorded() {
+        if strings.HasPrefix(cmd, "T ") == true {
+            titles = append(titles, cmd[2:])
+        }
+    }
+    if want := []string{"Hours Only", "Evening News"}; slices.Equal(titles, want) == false {
+        t.Errorf("events sent: got %q, want %q", titles, want)
+    }
+}
+
+// a dry run with SimulateSlowVDR over the timeout fails like a slow VDR
+// would, at the greeting
+func TestDryRunTimeout(t *testing.T) {
+    opts := test_load_options()
+    opts.DryRun = true
+    opts.Timeout = 10 * time.Millisecond
+    opts.SimulateSlowVDR = 50 * time.Millisecond
+
+    comm := make(chan VDREPGEvent)
+    close(comm)
+    ld := Loader{Options: opts}
+    _, err := ld.Load(context.Background(), test_channels(), comm)
+    if err == nil || strings.Contains(err.Error(), "no reply within 10ms") == false {
+        t.Errorf("got %v, want a timeout", err)
+    }
+}
+
+// the per channel totals count events only, not the PUTE blocks; a feed
+// coming back to a channel opens a second block for it
+func TestLoadChannelCounts(t *testing.T) {
+    f := fake_vdr(t)
+    events := []VDREPGEvent{
+        test_event("WCVB", "20240101180000 +0000", "20240101183000 +0000", "Evening News"),
+        test_event("WGBH", "20240101180000 +0000", "20240101190000 +0000", "Nova"),
+        test_event("WCVB", "20240101183000 +0000", "20240101190000 +0000", "Weather"),
+        test_event("WCVB", "20240101190000 +0000", "20240101193000 +0000", "Sports"),
+    }
+    sum, err := test_load(f, test_load_options(), events)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    blocks := 0
+    for _, cmd := range f.recorded() {
+        if cmd == "PUTE" {
+            blocks++
+        }
+    }
+    if blocks != 3 {
+        t.Errorf("%d PUTE blocks, want 3", blocks)
+    }
+    if want := map[string]int{"WCVB": 3, "WGBH": 1}; maps.Equal(sum.Channels, want) == false {
+        t.Errorf("channel totals %v, want %v", sum.Channels, want)
+    }
+}
+
+func TestParseXMLTVBOM(t *testing.T) {
+    doc := `<?xml version="1.0" encoding="UTF-8"?>
+<tv><channel id="WCVB"><display-name>WCVB</display-name></channel>
+<programme start="20240101180000 +0000" stop="20240101183000 +0000" channel="WCVB"><title>Evening News</title></programme></tv>`
+
+    for _, tc := range []struct {
+        name string
+        data string
+    }{
+        {"with BOM", "\xEF\xBB\xBF" + doc},
+        {"without BOM", doc},
+        {"BOM, no declaration", "\xEF\xBB\xBF" + doc[strings.Index(doc, "<tv>"):]},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            chs, progs, err := ParseXMLTV(strings.NewReader(tc.data), XMLTVOptions{})
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(chs) != 1 || len(progs) != 1 || progs[0].Title != "Evening News" {
+                t.Errorf("got %d channels, %d programmes (%v)", len(chs), len(progs), progs)
+            }
+        })
+    }
+
+    // shorter than a BOM, nothing to peek at but nothing lost either
+    data, _ := io.ReadAll(strip_bom(strings.NewReader("<a"), discard_logger()))
+    if string(data) != "<a" {
+        t.Errorf("strip_bom of a short input: %q", data)
+    }
+}
+
+var update = flag.Bool("update", false, "rewrite the testdata/*.golden files")
+
+// compares got to testdata/<name>.golden, rewrites it with -update
+func golden(t *testing.T, name string, got []byte) {
+    t.Helper()
+    path := filepath.Join("testdata", name+".golden")
+    if *update == true {
+        if err := os.WriteFile(path, got, 0644); err != nil {
+            t.Fatal(err)
+        }
+        return
+    }
+    want, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Equal(got, want) == false {
+        t.Errorf("%s differs:\n%s\nwant:\n%s", path, got, want)
+    }
+}
+
+// the PUTE blocks of a testdata feed: every programme through
+// xmltv_to_event and vdr_format_event, a C ... c frame per channel.
+// channels are matched to test_channels by display-name, a Schedules
+// Direct station by its callsign
+func TestFormatEvent(t *testing.T) {
+    for _, tc := range []struct {
+        name   string
+        file   string
+        format string
+    }{
+        {"format", "format.xml", ""},
+        {"sd-json", "sd-json.json", INPUT_FORMAT_SD_JSON},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            f, err := os.Open(filepath.Join("testdata", tc.file))
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer f.Close()
+
+            xopts := XMLTVOptions{GenreMode: GENRE_MODE_ALL, DescSeparator: "|", InputFormat: tc.format, Log: discard_logger()}
+            feed, progs, err := parse_epg_input(f, xopts)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            chs := test_channels()
+            callsigns := make(map[string]string)
+            for _, ch := range feed {
+                callsigns[ch.Id] = xmltv_match_channel(ch, chs, NamePriority{}, false, discard_logger())
+            }
+            opts := test_load_options()
+            opts.LineEnding = LINE_ENDING_LF
+
+            var b bytes.Buffer
+            cur := ""
+            for _, p := range progs {
+                cs := callsigns[p.Channel]
+                if cs == "" {
+                    t.Fatalf("channel %s not matched", p.Channel)
+                }
+                if cs != cur {
+                    if cur != "" {
+                        b.WriteString("c\n.\n")
+                    }
+                    cur = cs
+                    fmt.Fprintf(&b, "PUTE\nC %s %s\n", chs[cur].ChannelId, cur)
+                }
+                if err := vdr_format_event(&b, xmltv_to_event(p, cur, xopts), opts); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            b.WriteString("c\n.\n")
+            golden(t, tc.name, b.Bytes())
+        })
+    }
+}
+
+// what vdr_format_event sends has to come back the same from LSTE, or
+// every event shows up as changed in a diff
+func TestFormatParseRoundTrip(t *testing.T) {
+    f, err := os.Open(filepath.Join("testdata", "format.xml"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+
+    xopts := XMLTVOptions{GenreMode: GENRE_MODE_ALL, DescSeparator: "|", Log: discard_logger()}
+    _, progs, err := ParseXMLTV(f, xopts)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    chs := test_channels()
+    opts := test_load_options()
+    opts.LineEnding = LINE_ENDING_LF
+    for _, p := range progs {
+        e := xmltv_to_event(p, p.Channel, xopts)
+        var b bytes.Buffer
+        fmt.Fprintf(&b, "C %s %s\n", chs[p.Channel].ChannelId, p.Channel)
+        if err := vdr_format_event(&b, e, opts); err != nil {
+            t.Fatal(err)
+        }
+        b.WriteString("c\n")
+
+        got, err := vdr_parse_epg(b.String(), chs)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(got) != 1 {
+            t.Fatalf("%s: got %d events back, want 1", e.TTitle, len(got))
+        }
+        if vdr_events_equal(e, got[0]) == false {
+            t.Errorf("%s: sent %+v, got back %+v", e.TTitle, e, got[0])
+        }
+    }
+}
+
+// a made up feed of n programmes over 10 channels with what real feeds
+// carry: several categories, a pretty printed desc, a rating, ...
+func bench_sample(n int) []byte {
+    var b bytes.Buffer
+    b.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<tv>\n")
+    for c := 0; c < 10; c++ {
+        fmt.Fprintf(&b, "<channel id=\"ch%d.bench\"><display-name>BENCH%d</display-name></channel>\n", c, c)
+    }
+
+    start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    for i := 0; i < n; i++ {
+        ts := start.Add(time.Duration(i/10) * 30 * time.Minute)
+        fmt.Fprintf(&b, "<programme start=\"%s\" stop=\"%s\" channel=\"ch%d.bench\">\n", ts.Format("20060102150405 -0700"), ts.Add(30*time.Minute).Format("20060102150405 -0700"), i%10)
+        fmt.Fprintf(&b, "  <title lang=\"en\">Programme %d</title>\n  <sub-title lang=\"en\">Episode %d</sub-title>\n", i, i%25)
+        b.WriteString("  <desc lang=\"en\">\n    A description of the programme, pretty\n    printed over a few lines.\n\n    And a second paragraph.\n  </desc>\n")
+        b.WriteString("  <date>1997</date>\n  <category lang=\"en\">Movie</category>\n  <category lang=\"en\">Comedy</category>\n  <category>violence</category>\n")
+        b.WriteString("  <country>USA</country>\n  <video><aspect>16:9</aspect></video>\n  <audio><stereo>stereo</stereo></audio>\n")
+        b.WriteString("  <rating system=\"MPAA\"><value>PG-13</value></rating>\n</programme>\n")
+    }
+    b.WriteString("</tv>\n")
+    return b.Bytes()
+}
+
+func BenchmarkParseXMLTV(b *testing.B) {
+    data := bench_sample(1000)
+    opts := XMLTVOptions{Log: discard_logger()}
+    b.SetBytes(int64(len(data)))
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        if _, _, err := ParseXMLTV(bytes.NewReader(data), opts); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+func bench_programmes(b *testing.B) []Programme {
+    _, progs, err := ParseXMLTV(bytes.NewReader(bench_sample(1000)), XMLTVOptions{Log: discard_logger()})
+    if err != nil {
+        b.Fatal(err)
+    }
+    return progs
+}
+
+func BenchmarkXMLTVToEvent(b *testing.B) {
+    progs := bench_programmes(b)
+    opts := XMLTVOptions{Log: discard_logger()}
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        xmltv_to_event(progs[i%len(progs)], "BENCH", opts)
+    }
+}
+
+func BenchmarkFormatEvent(b *testing.B) {
+    progs := bench_programmes(b)
+    xopts := XMLTVOptions{Log: discard_logger()}
+    events := make([]VDREPGEvent, len(progs))
+    for i, p := range progs {
+        events[i] = xmltv_to_event(p, "BENCH", xopts)
+    }
+    opts := test_load_options()
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        vdr_format_event(io.Discard, events[i%len(events)], opts)
+    }
+}